@@ -0,0 +1,78 @@
+package esitag
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Kind classifies which ESI construct an Entity represents. The zero value,
+// KindInclude, is the plain <esi:include> tag ParseRaw has always understood.
+type Kind uint8
+
+const (
+	// KindInclude is a single <esi:include src="..."/> tag.
+	KindInclude Kind = iota
+	// KindChoose is an <esi:choose> block, see Entity.Choose.
+	KindChoose
+	// KindTry is an <esi:try> block, see Entity.Try.
+	KindTry
+	// KindVars is an <esi:vars> tag, see Entity.Vars.
+	KindVars
+)
+
+// When represents a single <esi:when test="..."> branch inside an
+// <esi:choose> block. Body holds the branch's raw, unparsed bytes; they are
+// only scanned into Entities once the branch is actually selected, via
+// Render, so a losing branch's markup is never queried.
+type When struct {
+	Test conditionNode
+	Body []byte
+}
+
+// Choose represents a parsed <esi:choose> block. At render time the first
+// When whose Test evaluates to true is used; if none matches, Otherwise is
+// used instead, which may itself be empty.
+type Choose struct {
+	Whens     []*When
+	Otherwise []byte
+}
+
+// NewChoose compiles the test expression of every when branch and assembles
+// a Choose value. ScanEntities is responsible for grouping the raw
+// <esi:when>/<esi:otherwise> children of an <esi:choose> block into
+// whenTests/whenBodies/otherwise before calling NewChoose; this function only
+// compiles the test expressions and wires up the result.
+func NewChoose(whenTests []string, whenBodies [][]byte, otherwise []byte) (*Choose, error) {
+	if len(whenTests) != len(whenBodies) {
+		return nil, errors.Errorf("[esitag] NewChoose: got %d when tests but %d when bodies", len(whenTests), len(whenBodies))
+	}
+	c := &Choose{
+		Whens:     make([]*When, 0, len(whenTests)),
+		Otherwise: otherwise,
+	}
+	for i, test := range whenTests {
+		node, err := parseExpression(test)
+		if err != nil {
+			return nil, errors.Wrapf(err, "[esitag] NewChoose: when %d test %q", i, test)
+		}
+		c.Whens = append(c.Whens, &When{Test: node, Body: whenBodies[i]})
+	}
+	return c, nil
+}
+
+// Eval walks the When branches in order and returns the raw body of the
+// first branch whose Test evaluates to true. If none matches it returns
+// Otherwise, which may be nil.
+func (c *Choose) Eval(r *http.Request) ([]byte, error) {
+	for _, w := range c.Whens {
+		v, err := w.Test.Eval(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "[esitag] Choose.Eval")
+		}
+		if v.truthy() {
+			return w.Body, nil
+		}
+	}
+	return c.Otherwise, nil
+}
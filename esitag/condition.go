@@ -0,0 +1,586 @@
+package esitag
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// conditionValueKind distinguishes the dynamic type produced by evaluating a
+// conditionNode.
+type conditionValueKind uint8
+
+// Available conditionValue kinds. A conditionValue only ever carries the
+// field matching its kind.
+const (
+	kindString conditionValueKind = iota
+	kindNumber
+	kindBool
+)
+
+// conditionValue is the result of evaluating a conditionNode against a
+// request.
+type conditionValue struct {
+	kind conditionValueKind
+	str  string
+	num  float64
+	bl   bool
+}
+
+func stringValue(s string) conditionValue  { return conditionValue{kind: kindString, str: s} }
+func numberValue(n float64) conditionValue { return conditionValue{kind: kindNumber, num: n} }
+func boolValue(b bool) conditionValue      { return conditionValue{kind: kindBool, bl: b} }
+
+// truthy implements the ESI notion of "true": booleans are themselves,
+// numbers are true unless zero and strings are true unless empty.
+func (v conditionValue) truthy() bool {
+	switch v.kind {
+	case kindBool:
+		return v.bl
+	case kindNumber:
+		return v.num != 0
+	default:
+		return v.str != ""
+	}
+}
+
+// asString renders v as a string for comparisons against a string operand.
+func (v conditionValue) asString() string {
+	switch v.kind {
+	case kindString:
+		return v.str
+	case kindBool:
+		if v.bl {
+			return "true"
+		}
+		return "false"
+	default:
+		return strconv.FormatFloat(v.num, 'g', -1, 64)
+	}
+}
+
+// asNumber renders v for comparisons against a numeric operand. ok is false
+// when v cannot be interpreted as a number.
+func (v conditionValue) asNumber() (float64, bool) {
+	switch v.kind {
+	case kindNumber:
+		return v.num, true
+	case kindString:
+		f, err := strconv.ParseFloat(v.str, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// conditionNode is implemented by every node of a parsed ESI test expression.
+// Eval resolves the node against the current request; it is called once per
+// incoming request, the expression itself having already been compiled to a
+// tree by parseExpression at tag-parse time.
+type conditionNode interface {
+	Eval(r *http.Request) (conditionValue, error)
+}
+
+// literalNode wraps a constant discovered while parsing, e.g. a number,
+// string or boolean.
+type literalNode struct{ v conditionValue }
+
+func (n literalNode) Eval(_ *http.Request) (conditionValue, error) { return n.v, nil }
+
+// regexNode wraps a `/pattern/` literal. It only has meaning as the
+// right-hand side of the `matches` operator, so evaluating it standalone is
+// an error.
+type regexNode struct{ re *regexp.Regexp }
+
+func (n regexNode) Eval(_ *http.Request) (conditionValue, error) {
+	return conditionValue{}, errors.Errorf("[esitag] regex literal %q cannot be evaluated on its own, it may only appear on the right of the matches operator", n.re.String())
+}
+
+// variableNode resolves a `$(NAME)` or `$(NAME{sub})` reference, falling
+// back to def when the variable is absent and hasDef is true.
+type variableNode struct {
+	name   string
+	sub    string
+	def    string
+	hasDef bool
+}
+
+func (n variableNode) Eval(r *http.Request) (conditionValue, error) {
+	if v, ok := resolveVariable(r, n.name, n.sub); ok {
+		return v, nil
+	}
+	if n.hasDef {
+		return stringValue(n.def), nil
+	}
+	return stringValue(""), nil
+}
+
+// resolveVariable looks up one of the ESI request variables. ok is false
+// when name is unknown or the referenced value is absent, in which case the
+// caller falls back to a |'default' suffix if one was given.
+func resolveVariable(r *http.Request, name, sub string) (conditionValue, bool) {
+	switch name {
+	case "HTTP_HOST":
+		return stringValue(r.Host), true
+	case "HTTP_REFERER":
+		v := r.Header.Get("Referer")
+		return stringValue(v), v != ""
+	case "HTTP_USER_AGENT":
+		v := r.Header.Get("User-Agent")
+		return stringValue(v), v != ""
+	case "HTTP_COOKIE":
+		c, err := r.Cookie(sub)
+		if err != nil {
+			return conditionValue{}, false
+		}
+		return stringValue(c.Value), true
+	case "HTTP_ACCEPT_LANGUAGE":
+		return boolValue(acceptsLanguage(r.Header.Get("Accept-Language"), sub)), true
+	case "QUERY_STRING":
+		if sub == "" {
+			return stringValue(r.URL.RawQuery), r.URL.RawQuery != ""
+		}
+		vals, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			return conditionValue{}, false
+		}
+		list, ok := vals[sub]
+		if !ok || len(list) == 0 {
+			return conditionValue{}, false
+		}
+		return stringValue(list[0]), true
+	case "REQUEST_METHOD":
+		return stringValue(r.Method), true
+	case "HTTP_HEADER":
+		if sub == "" {
+			return conditionValue{}, false
+		}
+		v := r.Header.Get(sub)
+		if v == "" {
+			return conditionValue{}, false
+		}
+		return stringValue(v), true
+	case "REQUEST_PATH":
+		return stringValue(r.URL.Path), true
+	}
+	return conditionValue{}, false
+}
+
+// acceptsLanguage reports whether lang (e.g. "en" or "en-US") is present in
+// an Accept-Language header value, matching a bare language against any of
+// its regional variants.
+func acceptsLanguage(header, lang string) bool {
+	if header == "" || lang == "" {
+		return false
+	}
+	lang = strings.ToLower(lang)
+	for _, part := range strings.Split(header, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		if tag == lang || strings.HasPrefix(tag, lang+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// unaryNotNode negates its operand's truthiness, implementing the `!`
+// operator.
+type unaryNotNode struct{ operand conditionNode }
+
+func (n unaryNotNode) Eval(r *http.Request) (conditionValue, error) {
+	v, err := n.operand.Eval(r)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	return boolValue(!v.truthy()), nil
+}
+
+// logicalNode implements the `&` and `|` boolean operators with short
+// circuiting, as in Go.
+type logicalNode struct {
+	op    string // "&" or "|"
+	left  conditionNode
+	right conditionNode
+}
+
+func (n logicalNode) Eval(r *http.Request) (conditionValue, error) {
+	l, err := n.left.Eval(r)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	if n.op == "&" && !l.truthy() {
+		return boolValue(false), nil
+	}
+	if n.op == "|" && l.truthy() {
+		return boolValue(true), nil
+	}
+	right, err := n.right.Eval(r)
+	if err != nil {
+		return conditionValue{}, err
+	}
+	return boolValue(right.truthy()), nil
+}
+
+// compareNode implements the comparison and string operators: ==, !=, <,
+// <=, >, >=, has, has_i and matches.
+type compareNode struct {
+	op    string
+	left  conditionNode
+	right conditionNode
+}
+
+func (n compareNode) Eval(r *http.Request) (conditionValue, error) {
+	left, err := n.left.Eval(r)
+	if err != nil {
+		return conditionValue{}, err
+	}
+
+	if n.op == "matches" {
+		re, ok := n.right.(regexNode)
+		if !ok {
+			return conditionValue{}, errors.Errorf("[esitag] the matches operator requires a /regex/ literal on its right-hand side")
+		}
+		return boolValue(re.re.MatchString(left.asString())), nil
+	}
+
+	right, err := n.right.Eval(r)
+	if err != nil {
+		return conditionValue{}, err
+	}
+
+	switch n.op {
+	case "has", "has_i":
+		hay, needle := left.asString(), right.asString()
+		if n.op == "has_i" {
+			hay, needle = strings.ToLower(hay), strings.ToLower(needle)
+		}
+		return boolValue(strings.Contains(hay, needle)), nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		return compareValues(n.op, left, right)
+	}
+	return conditionValue{}, errors.Errorf("[esitag] unknown comparison operator %q", n.op)
+}
+
+// compareValues compares l and r numerically when both sides can be parsed
+// as numbers, and lexically otherwise.
+func compareValues(op string, l, r conditionValue) (conditionValue, error) {
+	if ln, lok := l.asNumber(); lok {
+		if rn, rok := r.asNumber(); rok {
+			return boolValue(applyCmp(op, cmpFloat(ln, rn))), nil
+		}
+	}
+	return boolValue(applyCmp(op, strings.Compare(l.asString(), r.asString()))), nil
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func applyCmp(op string, cmp int) bool {
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// conditionExpr adapts a parsed expression tree to the Conditioner
+// interface so Entity.OK stays a cheap tree walk at request time; the
+// expensive parsing happens once in parseCondition.
+type conditionExpr struct {
+	node conditionNode
+}
+
+func (c conditionExpr) OK(r *http.Request) bool {
+	v, err := c.node.Eval(r)
+	if err != nil {
+		return false
+	}
+	return v.truthy()
+}
+
+// exprParser is a small recursive-descent parser for the ESI test grammar:
+// literals, $(VAR) references, comparisons, has/has_i/matches, the boolean
+// operators & | ! and parenthesised grouping.
+type exprParser struct {
+	s   string
+	pos int
+}
+
+// parseExpression compiles an ESI test expression, as found in a
+// condition="..." or <esi:when test="..."> attribute, into a conditionNode
+// tree.
+func parseExpression(s string) (conditionNode, error) {
+	p := &exprParser{s: s}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, errors.Errorf("[esitag] parseExpression: unexpected trailing input %q in %q", p.s[p.pos:], s)
+	}
+	return node, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.peek() != '|' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "|", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.peek() != '&' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (conditionNode, error) {
+	p.skipSpace()
+	if p.peek() == '!' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNotNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var wordOperators = []string{"has_i", "has", "matches"}
+var symbolOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func (p *exprParser) parseComparison() (conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	op, ok := p.peekOperator()
+	if !ok {
+		return left, nil
+	}
+	p.pos += len(op)
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) peekOperator() (string, bool) {
+	rest := p.s[p.pos:]
+	for _, op := range symbolOperators {
+		if strings.HasPrefix(rest, op) {
+			return op, true
+		}
+	}
+	for _, op := range wordOperators {
+		if strings.HasPrefix(rest, op) {
+			after := rest[len(op):]
+			if len(after) == 0 || after[0] == ' ' || after[0] == '(' || after[0] == '$' || after[0] == '\'' {
+				return op, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parsePrimary() (conditionNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return nil, errors.Errorf("[esitag] parsePrimary: unexpected end of expression %q", p.s)
+	}
+	switch c := p.s[p.pos]; {
+	case c == '(':
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.peek() != ')' {
+			return nil, errors.Errorf("[esitag] parsePrimary: missing closing paren in %q", p.s)
+		}
+		p.pos++
+		return node, nil
+	case c == '\'':
+		return p.parseStringLiteral()
+	case c == '$':
+		return p.parseVariable()
+	case c == '/':
+		return p.parseRegex()
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case strings.HasPrefix(p.s[p.pos:], "true"):
+		p.pos += 4
+		return literalNode{v: boolValue(true)}, nil
+	case strings.HasPrefix(p.s[p.pos:], "false"):
+		p.pos += 5
+		return literalNode{v: boolValue(false)}, nil
+	default:
+		return nil, errors.Errorf("[esitag] parsePrimary: unexpected character %q at position %d in %q", c, p.pos, p.s)
+	}
+}
+
+func (p *exprParser) parseStringLiteral() (*literalNode, error) {
+	p.pos++ // opening quote
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != '\'' {
+		p.pos++
+	}
+	if p.pos >= len(p.s) {
+		return nil, errors.Errorf("[esitag] parseStringLiteral: unterminated string in %q", p.s)
+	}
+	val := p.s[start:p.pos]
+	p.pos++ // closing quote
+	return &literalNode{v: stringValue(val)}, nil
+}
+
+func (p *exprParser) parseNumber() (conditionNode, error) {
+	start := p.pos
+	if p.s[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		return nil, errors.Errorf("[esitag] parseNumber: invalid number %q in %q", p.s[start:p.pos], p.s)
+	}
+	return literalNode{v: numberValue(f)}, nil
+}
+
+func (p *exprParser) parseRegex() (conditionNode, error) {
+	p.pos++ // opening slash
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != '/' {
+		if p.s[p.pos] == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.s) {
+		return nil, errors.Errorf("[esitag] parseRegex: unterminated regex in %q", p.s)
+	}
+	pattern := p.s[start:p.pos]
+	p.pos++ // closing slash
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Errorf("[esitag] parseRegex: invalid regex %q: %s", pattern, err)
+	}
+	return regexNode{re: re}, nil
+}
+
+func (p *exprParser) parseVariable() (conditionNode, error) {
+	p.pos++ // '$'
+	if p.peek() != '(' {
+		return nil, errors.Errorf("[esitag] parseVariable: expected '(' after '$' in %q", p.s)
+	}
+	p.pos++
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ')' && p.s[p.pos] != '{' && p.s[p.pos] != '|' {
+		p.pos++
+	}
+	name := p.s[start:p.pos]
+
+	var sub string
+	if p.peek() == '{' {
+		p.pos++
+		subStart := p.pos
+		for p.pos < len(p.s) && p.s[p.pos] != '}' {
+			p.pos++
+		}
+		if p.pos >= len(p.s) {
+			return nil, errors.Errorf("[esitag] parseVariable: unterminated '{' in %q", p.s)
+		}
+		sub = p.s[subStart:p.pos]
+		p.pos++ // '}'
+	}
+
+	n := variableNode{name: name, sub: sub}
+
+	// an optional |'default' suffix, inside the parens: $(NAME{sub}|'default').
+	if p.peek() == '|' {
+		p.pos++
+		if p.peek() != '\'' {
+			return nil, errors.Errorf("[esitag] parseVariable: expected string literal after '|' in %q", p.s)
+		}
+		lit, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		n.def = lit.v.str
+		n.hasDef = true
+	}
+
+	if p.peek() != ')' {
+		return nil, errors.Errorf("[esitag] parseVariable: expected ')' in %q", p.s)
+	}
+	p.pos++ // ')'
+
+	return n, nil
+}
@@ -0,0 +1,148 @@
+package esitag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func evalExpr(t *testing.T, expr string, r *http.Request) conditionValue {
+	t.Helper()
+	node, err := parseExpression(expr)
+	if err != nil {
+		t.Fatalf("parseExpression(%q): %v", expr, err)
+	}
+	v, err := node.Eval(r)
+	if err != nil {
+		t.Fatalf("Eval(%q): %v", expr, err)
+	}
+	return v
+}
+
+func TestParseExpressionLiterals(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		expr   string
+		truthy bool
+	}{
+		{"'hello'", true},
+		{"''", false},
+		{"1", true},
+		{"0", false},
+		{"true", true},
+		{"false", false},
+	}
+	for _, tc := range tests {
+		if got := evalExpr(t, tc.expr, r).truthy(); got != tc.truthy {
+			t.Errorf("%q: truthy() = %v, want %v", tc.expr, got, tc.truthy)
+		}
+	}
+}
+
+func TestParseExpressionComparisons(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"1 == 1", true},
+		{"1 == 2", false},
+		{"1 != 2", true},
+		{"2 > 1", true},
+		{"2 >= 2", true},
+		{"1 < 2", true},
+		{"2 <= 1", false},
+		{"'abc' == 'abc'", true},
+		{"'abc' == 'abd'", false},
+		{"'ab' < 'b'", true},
+	}
+	for _, tc := range tests {
+		v := evalExpr(t, tc.expr, r)
+		if v.kind != kindBool {
+			t.Fatalf("%q: expected bool result, got kind %v", tc.expr, v.kind)
+		}
+		if v.bl != tc.want {
+			t.Errorf("%q = %v, want %v", tc.expr, v.bl, tc.want)
+		}
+	}
+}
+
+func TestParseExpressionHasAndMatches(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"'hello world' has 'world'", true},
+		{"'hello world' has 'WORLD'", false},
+		{"'hello world' has_i 'WORLD'", true},
+		{"'hello world' matches /wo.ld/", true},
+		{"'hello world' matches /^world$/", false},
+	}
+	for _, tc := range tests {
+		if got := evalExpr(t, tc.expr, r).bl; got != tc.want {
+			t.Errorf("%q = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseExpressionBooleanOps(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"1 == 1 & 2 == 2", true},
+		{"1 == 1 & 2 == 3", false},
+		{"1 == 2 | 2 == 2", true},
+		{"1 == 2 | 2 == 3", false},
+		{"!(1 == 2)", true},
+		{"!(1 == 1)", false},
+		{"(1 == 1 | 1 == 2) & 2 == 2", true},
+	}
+	for _, tc := range tests {
+		if got := evalExpr(t, tc.expr, r).bl; got != tc.want {
+			t.Errorf("%q = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseExpressionVariables(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/path?foo=bar", nil)
+	r.Host = "example.com"
+	r.Header.Set("User-Agent", "MobileSafari/1.0")
+	r.AddCookie(&http.Cookie{Name: "uid", Value: "42"})
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"$(HTTP_HOST) == 'example.com'", true},
+		{"$(HTTP_USER_AGENT) matches /Mobile/", true},
+		{"$(HTTP_COOKIE{uid}) == '42'", true},
+		{"$(HTTP_COOKIE{missing}|'anon') == 'anon'", true},
+		{"$(QUERY_STRING{foo}) == 'bar'", true},
+		{"$(REQUEST_METHOD) == 'GET'", true},
+		{"$(REQUEST_PATH) == '/path'", true},
+	}
+	for _, tc := range tests {
+		if got := evalExpr(t, tc.expr, r).bl; got != tc.want {
+			t.Errorf("%q = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseExpressionSyntaxErrors(t *testing.T) {
+	tests := []string{
+		"1 ==",
+		"(1 == 1",
+		"'unterminated",
+		"1 == 1 trailing garbage",
+		"/unterminated",
+	}
+	for _, expr := range tests {
+		if _, err := parseExpression(expr); err == nil {
+			t.Errorf("parseExpression(%q): expected error, got nil", expr)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package esitag
+
+import "bytes"
+
+// esiEscapeStart and esiEscapeEnd delimit an ESI "escape block": origin
+// servers wrap ESI markup inside an HTML comment so that non-ESI-aware
+// caches and browsers ignore it, e.g. `<!--esi <esi:include src="..."/> -->`.
+var (
+	esiEscapeStart = []byte("<!--esi")
+	esiEscapeEnd   = []byte("-->")
+	esiRemoveStart = []byte("<esi:remove>")
+	esiRemoveEnd   = []byte("</esi:remove>")
+)
+
+// StripEscapeComments unwraps every `<!--esi ... -->` block in data, leaving
+// its contents in place so the regular `<esi:` tag scan that produces
+// Entity.RawTag finds the tags inside it, and dropping the wrapping comment
+// markers themselves from the returned byte stream. It must run before that
+// tag scan. Content outside of escape blocks is left untouched.
+func StripEscapeComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		idx := bytes.Index(data, esiEscapeStart)
+		if idx < 0 {
+			out = append(out, data...)
+			break
+		}
+		out = append(out, data[:idx]...)
+		data = data[idx+len(esiEscapeStart):]
+
+		end := bytes.Index(data, esiEscapeEnd)
+		if end < 0 {
+			// unterminated escape block: treat the rest of the stream as its
+			// body, matching the non-greedy intent of the opening marker.
+			out = append(out, data...)
+			break
+		}
+		out = append(out, data[:end]...)
+		data = data[end+len(esiEscapeEnd):]
+	}
+	return out
+}
+
+// StripRemoveTags deletes every `<esi:remove>...</esi:remove>` block from
+// data, body included. It is the converse of an escape block: origins use it
+// to ship fallback markup that should only be shown when ESI processing is
+// unavailable, so an ESI-aware cache must remove it entirely. Nested
+// esi:remove blocks are matched by depth so that an inner close tag does not
+// prematurely end the outer block.
+func StripRemoveTags(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		idx := bytes.Index(data, esiRemoveStart)
+		if idx < 0 {
+			out = append(out, data...)
+			break
+		}
+		out = append(out, data[:idx]...)
+		data = data[idx+len(esiRemoveStart):]
+
+		end := indexBalancedEnd(data, esiRemoveStart, esiRemoveEnd)
+		if end < 0 {
+			// unterminated esi:remove: drop the rest of the stream along
+			// with it rather than emitting a half-removed fragment.
+			break
+		}
+		data = data[end+len(esiRemoveEnd):]
+	}
+	return out
+}
+
+// indexBalancedEnd returns the index, within data, of the endMarker that
+// closes the startMarker the caller has already consumed, treating any
+// further occurrence of startMarker before that point as opening a nested
+// block of the same kind. It returns -1 if data contains no balancing
+// endMarker.
+func indexBalancedEnd(data []byte, startMarker, endMarker []byte) int {
+	depth := 1
+	pos := 0
+	for {
+		end := bytes.Index(data[pos:], endMarker)
+		if end < 0 {
+			return -1
+		}
+		end += pos
+
+		start := bytes.Index(data[pos:end], startMarker)
+		if start < 0 {
+			depth--
+			if depth == 0 {
+				return end
+			}
+			pos = end + len(endMarker)
+			continue
+		}
+		depth++
+		pos = pos + start + len(startMarker)
+	}
+}
+
+// Preprocess runs the escape-comment and esi:remove passes over data before
+// the `<esi:` tag scan builds Entities from it.
+func Preprocess(data []byte) []byte {
+	return StripRemoveTags(StripEscapeComments(data))
+}
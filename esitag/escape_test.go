@@ -0,0 +1,78 @@
+package esitag
+
+import "testing"
+
+func TestStripEscapeComments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "single block",
+			in:   `a <!--esi <esi:include src="x"/> --> b`,
+			want: `a  <esi:include src="x"/>  b`,
+		},
+		{
+			name: "no block",
+			in:   "plain text",
+			want: "plain text",
+		},
+		{
+			name: "unterminated block",
+			in:   `a <!--esi <esi:include src="x"/>`,
+			want: `a  <esi:include src="x"/>`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(StripEscapeComments([]byte(tc.in))); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripRemoveTags(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "single block",
+			in:   "a <esi:remove>fallback</esi:remove> b",
+			want: "a  b",
+		},
+		{
+			name: "nested blocks",
+			in:   "a <esi:remove>A<esi:remove>B</esi:remove>C</esi:remove> b",
+			want: "a  b",
+		},
+		{
+			name: "no block",
+			in:   "plain text",
+			want: "plain text",
+		},
+		{
+			name: "two sibling blocks",
+			in:   "<esi:remove>one</esi:remove>mid<esi:remove>two</esi:remove>",
+			want: "mid",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(StripRemoveTags([]byte(tc.in))); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	in := `<!--esi <esi:include src="x"/> --><esi:remove>fallback</esi:remove>`
+	want := ` <esi:include src="x"/> `
+	if got := string(Preprocess([]byte(in))); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,6 +2,7 @@ package esitag
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,15 +29,6 @@ type Conditioner interface {
 	OK(r *http.Request) bool
 }
 
-type condition struct {
-	*template.Template
-}
-
-func (c condition) OK(r *http.Request) bool {
-	// todo
-	return false
-}
-
 // Tag identifies an ESI tag by its start and end position in the HTML byte
 // stream for replacing. If the HTML changes there needs to be a refresh call to
 // re-parse the HTML.
@@ -59,7 +51,16 @@ type Entity struct {
 	ForwardHeadersAll bool
 	ReturnHeaders     []string
 	ReturnHeadersAll  bool
-	Conditioner       // todo
+	Conditioner
+	// Kind classifies this Entity; KindChoose, KindTry and KindVars
+	// entities populate Choose/Try/Vars instead of Resources/Conditioner.
+	Kind   Kind
+	Choose *Choose
+	Try    *Try
+	Vars   *Vars
+	// resourceVars holds the compiled $(...) program for every src/key that
+	// carries ESI variable references, populated by parseResource.
+	resourceVars []resourceVarsEntry
 }
 
 // todo split into two regexs for better performance and use the single quote regex only then when the first one returns nothing
@@ -152,11 +153,11 @@ func (et *Entity) ParseRaw() error {
 }
 
 func (et *Entity) parseCondition(s string) error {
-	tpl, err := template.New("condition").Parse(s)
+	node, err := parseExpression(s)
 	if err != nil {
-		errors.Errorf("[caddyesi] ESITag.ParseRaw. Failed to parse %q as template with error: %s\nTag: %q", s, err, et.RawTag)
+		return errors.Errorf("[caddyesi] ESITag.ParseRaw. Failed to parse %q as ESI condition with error: %s\nTag: %q", s, err, et.RawTag)
 	}
-	et.Conditioner = condition{Template: tpl}
+	et.Conditioner = conditionExpr{node: node}
 	return nil
 }
 
@@ -173,6 +174,14 @@ func (et *Entity) parseResource(attr string, idx int, val string) error {
 	if attr == "key" && itemsIndexIdx >= 0 {
 		// r represents a pointer
 		r := et.Resources.Items[itemsIndexIdx] // it must panic if wrong
+		if hasVarsSyntax(val) {
+			prog, err := compileVars(val)
+			if err != nil {
+				return errors.Errorf("[caddyesi] ESITag.ParseRaw. Failed to parse %q as ESI variable reference with error: %s\nTag: %q", val, err, et.RawTag)
+			}
+			et.addResourceVars(attr, idx, prog)
+			return nil
+		}
 		if err := r.applyKey(val); err != nil {
 			return errors.Errorf("[caddyesi] ESITag.ParseRaw. Failed to parse %q as template with error: %s\nTag: %q", val, err, et.RawTag)
 		}
@@ -187,6 +196,16 @@ func (et *Entity) parseResource(attr string, idx int, val string) error {
 
 	r.IsURL = attr == "src" && strings.Contains(val, "://")
 	switch {
+	case hasVarsSyntax(val):
+		prog, err := compileVars(val)
+		if err != nil {
+			return errors.Errorf("[caddyesi] ESITag.ParseRaw. Failed to parse %q as ESI variable reference with error: %s\nTag: %q", val, err, et.RawTag)
+		}
+		et.addResourceVars(attr, idx, prog)
+		if attr == "src" {
+			// placeholder until ResolvedResources expands it per request
+			r.URL = val
+		}
 	case r.IsURL && strings.Contains(val, TemplateIdentifier):
 		var err error
 		r.URLTemplate, err = template.New("resource_tpl").Parse(val)
@@ -236,43 +255,126 @@ func (et Entities) String() string {
 // resources which are available in the current page. The returned Tag slice
 // does not guarantee to be ordered.
 func (et Entities) QueryResources(r *http.Request) ([]Tag, error) {
+	tags, err := et.queryResources(r.Context(), r)
+	if err != nil {
+		return nil, errors.Wrap(err, "[esitag]")
+	}
+	return tags, nil
+}
 
+// queryResources is the collecting counterpart of queryResourcesInto: it
+// resolves every Entity in et - recursing into KindChoose/KindTry branches -
+// and returns the accumulated Tags once all of them have either arrived or
+// failed. Try uses it to evaluate its Attempt branch as a unit before
+// deciding whether to keep or discard its output.
+func (et Entities) queryResources(ctx context.Context, r *http.Request) ([]Tag, error) {
 	tags := make([]Tag, 0, len(et))
-	g, ctx := errgroup.WithContext(r.Context())
 	cTag := make(chan Tag)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- et.queryResourcesInto(ctx, r, cTag)
+		close(cTag)
+	}()
+
+	for t := range cTag {
+		tags = append(tags, t)
+	}
+	return tags, <-errCh
+}
+
+// queryResourcesInto fans out et's entities, one goroutine each, and writes
+// each resolved Tag onto cTag as it arrives; queryResources collects them.
+// The chosen branch of an esi:choose or esi:try is not part of this fan-out:
+// queryInto renders it separately through Render.
+func (et Entities) queryResourcesInto(ctx context.Context, r *http.Request, cTag chan<- Tag) error {
+	g, ctx := errgroup.WithContext(ctx)
 	for _, e := range et {
 		e := e
 		g.Go(func() error {
-			data, err := e.Resources.DoRequest(e.Timeout, r)
-			if err != nil {
-				return errors.Wrapf(err, "[esitag] QueryResources.Resources.DoRequest failed for Tag %q", e.RawTag)
-			}
-			t := e.Tag
-			t.Data = data
+			return e.queryInto(ctx, r, cTag)
+		})
+	}
+	return g.Wait()
+}
+
+// queryInto resolves a single Entity, recursing into Choose or Try when e is
+// a block tag, or fetching its backend resource and emitting a Tag when it
+// is a plain KindInclude.
+func (e *Entity) queryInto(ctx context.Context, r *http.Request, cTag chan<- Tag) error {
+	switch e.Kind {
+	case KindChoose:
+		branch, err := e.Choose.Eval(r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] queryInto: esi:choose failed for Tag %q", e.RawTag)
+		}
+		data, err := Render(branch, r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] queryInto: esi:choose branch failed to render for Tag %q", e.RawTag)
+		}
+		t := e.Tag
+		t.Data = data
 
+		select {
+		case cTag <- t:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "[esitag] Context Done!")
+		}
+		return nil
+	case KindTry:
+		data, err := e.Try.Resolve(r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] queryInto: esi:try failed for Tag %q", e.RawTag)
+		}
+		t := e.Tag
+		t.Data = data
+
+		select {
+		case cTag <- t:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "[esitag] Context Done!")
+		}
+		return nil
+	case KindVars:
+		text, err := e.Vars.Eval(r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] queryInto: esi:vars failed for Tag %q", e.RawTag)
+		}
+		t := e.Tag
+		t.Data = []byte(text)
+
+		select {
+		case cTag <- t:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "[esitag] Context Done!")
+		}
+		return nil
+	default:
+		if e.Conditioner != nil && !e.Conditioner.OK(r) {
+			// condition="..." is false for this request: emit the Tag with
+			// no Data so the include is removed from the output.
 			select {
-			case cTag <- t:
+			case cTag <- e.Tag:
 			case <-ctx.Done():
 				return errors.Wrap(ctx.Err(), "[esitag] Context Done!")
 			}
 			return nil
-		})
-	}
-	go func() {
-		g.Wait()
-		close(cTag)
-	}()
-
-	for t := range cTag {
-		tags = append(tags, t)
-	}
+		}
+		resources, err := e.ResolvedResources(r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] queryInto: failed to resolve ESI variables for Tag %q", e.RawTag)
+		}
+		data, err := resources.DoRequest(e.Timeout, r)
+		if err != nil {
+			return errors.Wrapf(err, "[esitag] QueryResources.Resources.DoRequest failed for Tag %q", e.RawTag)
+		}
+		t := e.Tag
+		t.Data = data
 
-	// Check whether any of the goroutines failed. Since g is accumulating the
-	// errors, we don't need to send them (or check for them) in the individual
-	// results sent on the channel.
-	if err := g.Wait(); err != nil {
-		return nil, errors.Wrap(err, "[esitag]")
+		select {
+		case cTag <- t:
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "[esitag] Context Done!")
+		}
+		return nil
 	}
-
-	return tags, nil
 }
@@ -0,0 +1,48 @@
+package esitag
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Render runs the full ESI pipeline over data: escape/remove preprocessing,
+// tag scanning, resource resolution and tag replacement. It is the single
+// entry point for a top-level document, and is also called recursively to
+// render the chosen branch of an esi:choose or esi:try block, since that
+// branch's raw bytes may themselves contain any ESI construct.
+func Render(data []byte, r *http.Request) ([]byte, error) {
+	body := Preprocess(data)
+	entities, err := ScanEntities(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "[esitag] Render: scanning tags failed")
+	}
+	if len(entities) == 0 {
+		return body, nil
+	}
+	tags, err := entities.QueryResources(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "[esitag] Render: resolving resources failed")
+	}
+	return replaceTags(body, tags), nil
+}
+
+// replaceTags stitches body back together, substituting each Tag's byte
+// range with its fetched Data. QueryResources does not guarantee tags are
+// ordered, so they are sorted by start position first.
+func replaceTags(body []byte, tags []Tag) []byte {
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Start < tags[j].Start })
+
+	var out bytes.Buffer
+	out.Grow(len(body))
+	pos := 0
+	for _, t := range tags {
+		out.Write(body[pos:t.Start])
+		out.Write(t.Data)
+		pos = t.End
+	}
+	out.Write(body[pos:])
+	return out.Bytes()
+}
@@ -0,0 +1,205 @@
+package esitag
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	selfClosingInclude = regexp.MustCompile(`<esi:include\s[^>]*/>`)
+	nextBlockTag       = regexp.MustCompile(`<esi:(include|choose|try|vars)\b`)
+
+	chooseStart = []byte("<esi:choose>")
+	chooseEnd   = []byte("</esi:choose>")
+	whenOpenTag = regexp.MustCompile(`<esi:when\s+test="([^"\r\n]*)"\s*>|<esi:when\s+test='([^'\r\n]*)'\s*>`)
+	whenStart   = []byte("<esi:when")
+	whenEnd     = []byte("</esi:when>")
+	otherwStart = []byte("<esi:otherwise>")
+	otherwEnd   = []byte("</esi:otherwise>")
+
+	tryStart     = []byte("<esi:try>")
+	tryEnd       = []byte("</esi:try>")
+	attemptStart = []byte("<esi:attempt>")
+	attemptEnd   = []byte("</esi:attempt>")
+	exceptStart  = []byte("<esi:except>")
+	exceptEnd    = []byte("</esi:except>")
+
+	varsStart = []byte("<esi:vars>")
+	varsEnd   = []byte("</esi:vars>")
+)
+
+// ScanEntities walks data looking for top-level <esi:include/>, <esi:choose>,
+// <esi:try> and <esi:vars> tags and returns one Entity per match, in
+// document order. It does not descend into a choose/try branch's body -
+// that raw span is only scanned once Choose.Eval/Try.Resolve has picked it,
+// recursively, via Render - so a losing branch is never touched and its
+// Start/End always describe one uninspected span of the byte stream.
+func ScanEntities(data []byte) (Entities, error) {
+	var entities Entities
+	pos := 0
+	for pos < len(data) {
+		loc := nextBlockTag.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		start := pos + loc[0]
+		kind := string(data[pos+loc[2] : pos+loc[3]])
+
+		var (
+			e   *Entity
+			end int
+			err error
+		)
+		switch kind {
+		case "include":
+			m := selfClosingInclude.FindIndex(data[start:])
+			if m == nil || m[0] != 0 {
+				pos = start + len("<esi:")
+				continue
+			}
+			end = start + m[1]
+			e = &Entity{RawTag: data[start:end], Tag: Tag{Start: start, End: end}}
+		case "choose":
+			e, end, err = parseChoose(data, start)
+		case "try":
+			e, end, err = parseTry(data, start)
+		case "vars":
+			e, end, err = parseVars(data, start)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			// The keyword matched but the construct was malformed (e.g. an
+			// opening tag with no matching close); skip past the keyword and
+			// keep scanning the rest of the document rather than aborting.
+			pos = start + len("<esi:")
+			continue
+		}
+		entities = append(entities, e)
+		pos = end
+	}
+	if err := entities.ParseRaw(); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// parseChoose parses the <esi:choose> block beginning at start, data[start:]
+// being taken to begin with exactly "<esi:choose>" (the caller's keyword
+// match only confirms the "<esi:choose" prefix), and returns an Entity spanning the whole block plus the
+// index immediately following its closing tag.
+func parseChoose(data []byte, start int) (*Entity, int, error) {
+	bodyStart := start + len(chooseStart)
+	bodyEnd := indexBalancedEnd(data[bodyStart:], chooseStart, chooseEnd)
+	if bodyEnd < 0 {
+		return nil, 0, nil
+	}
+	bodyEnd += bodyStart
+	end := bodyEnd + len(chooseEnd)
+	body := data[bodyStart:bodyEnd]
+
+	var tests []string
+	var whenBodies [][]byte
+	pos := 0
+	for pos < len(body) {
+		loc := whenOpenTag.FindSubmatchIndex(body[pos:])
+		if loc == nil {
+			break
+		}
+		var test []byte
+		if loc[2] >= 0 {
+			test = body[pos+loc[2] : pos+loc[3]]
+		} else {
+			test = body[pos+loc[4] : pos+loc[5]]
+		}
+		whenBodyStart := pos + loc[1]
+		whenBodyEnd := indexBalancedEnd(body[whenBodyStart:], whenStart, whenEnd)
+		if whenBodyEnd < 0 {
+			return nil, 0, errors.Errorf("[esitag] parseChoose: unterminated esi:when in %q", body)
+		}
+		whenBodyEnd += whenBodyStart
+
+		tests = append(tests, string(test))
+		whenBodies = append(whenBodies, body[whenBodyStart:whenBodyEnd])
+		pos = whenBodyEnd + len(whenEnd)
+	}
+
+	var otherwise []byte
+	if idx := bytes.Index(body[pos:], otherwStart); idx >= 0 {
+		otherwiseBodyStart := pos + idx + len(otherwStart)
+		otherwiseBodyEnd := indexBalancedEnd(body[otherwiseBodyStart:], otherwStart, otherwEnd)
+		if otherwiseBodyEnd < 0 {
+			return nil, 0, errors.Errorf("[esitag] parseChoose: unterminated esi:otherwise in %q", body)
+		}
+		otherwise = body[otherwiseBodyStart : otherwiseBodyStart+otherwiseBodyEnd]
+	}
+
+	choose, err := NewChoose(tests, whenBodies, otherwise)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Entity{Tag: Tag{Start: start, End: end}, Kind: KindChoose, Choose: choose}, end, nil
+}
+
+// parseTry parses the <esi:try> block beginning at start and returns an
+// Entity spanning the whole block plus the index following its closing tag.
+func parseTry(data []byte, start int) (*Entity, int, error) {
+	bodyStart := start + len(tryStart)
+	bodyEnd := indexBalancedEnd(data[bodyStart:], tryStart, tryEnd)
+	if bodyEnd < 0 {
+		return nil, 0, nil
+	}
+	bodyEnd += bodyStart
+	end := bodyEnd + len(tryEnd)
+	body := data[bodyStart:bodyEnd]
+
+	attempt, rest, err := extractBlock(body, attemptStart, attemptEnd)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "[esitag] parseTry: esi:attempt")
+	}
+	except, _, err := extractBlock(rest, exceptStart, exceptEnd)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "[esitag] parseTry: esi:except")
+	}
+
+	return &Entity{Tag: Tag{Start: start, End: end}, Kind: KindTry, Try: NewTry(attempt, except)}, end, nil
+}
+
+// parseVars parses the <esi:vars> tag beginning at start and returns an
+// Entity spanning the whole tag plus the index following its closing tag.
+func parseVars(data []byte, start int) (*Entity, int, error) {
+	bodyStart := start + len(varsStart)
+	bodyEnd := indexBalancedEnd(data[bodyStart:], varsStart, varsEnd)
+	if bodyEnd < 0 {
+		return nil, 0, nil
+	}
+	bodyEnd += bodyStart
+	end := bodyEnd + len(varsEnd)
+
+	v, err := NewVars(string(data[bodyStart:bodyEnd]))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "[esitag] parseVars")
+	}
+	return &Entity{Tag: Tag{Start: start, End: end}, Kind: KindVars, Vars: v}, end, nil
+}
+
+// extractBlock finds the first startMarker/endMarker pair in data, matched by
+// nesting depth, and returns its inner body plus the data that follows the
+// closing marker, so callers can chain extractBlock calls across sibling
+// blocks (e.g. esi:attempt followed by esi:except).
+func extractBlock(data, startMarker, endMarker []byte) (body, rest []byte, err error) {
+	idx := bytes.Index(data, startMarker)
+	if idx < 0 {
+		return nil, data, errors.Errorf("[esitag] extractBlock: %q not found", startMarker)
+	}
+	bodyStart := idx + len(startMarker)
+	bodyEnd := indexBalancedEnd(data[bodyStart:], startMarker, endMarker)
+	if bodyEnd < 0 {
+		return nil, nil, errors.Errorf("[esitag] extractBlock: unterminated %q", startMarker)
+	}
+	bodyEnd += bodyStart
+	return data[bodyStart:bodyEnd], data[bodyEnd+len(endMarker):], nil
+}
@@ -0,0 +1,39 @@
+package esitag
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Try represents a parsed <esi:try> block: Attempt is rendered first and, if
+// it succeeds, its output is used as-is. If any include inside Attempt fails
+// - a non-2xx status, a timed out request or any other error reported by
+// DoRequest - its partial output is discarded and Except is rendered in its
+// place instead. Except is only rendered once Attempt has failed, so a
+// healthy page never pays the cost of its fallback. Attempt and Except hold
+// raw, unparsed bytes so that a losing branch's markup is never queried.
+type Try struct {
+	Attempt []byte
+	Except  []byte
+}
+
+// NewTry wires up a Try from the attempt and except bodies ScanEntities
+// assembled for an <esi:try> block.
+func NewTry(attempt, except []byte) *Try {
+	return &Try{Attempt: attempt, Except: except}
+}
+
+// Resolve renders Attempt against r; if that fails, it falls back to
+// rendering Except instead.
+func (t *Try) Resolve(r *http.Request) ([]byte, error) {
+	out, err := Render(t.Attempt, r)
+	if err == nil {
+		return out, nil
+	}
+	out, err = Render(t.Except, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "[esitag] Try.Resolve: esi:except also failed")
+	}
+	return out, nil
+}
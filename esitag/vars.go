@@ -0,0 +1,154 @@
+package esitag
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// varsOp is one element of a compiled ESI variable-substitution program:
+// either a literal chunk of text or a reference to resolve per request.
+type varsOp struct {
+	literal string
+	ref     *variableNode // nil for a literal op
+}
+
+// varsProgram is a $(...)-bearing string compiled once at parse time, so
+// that resolving it against a request at render time is just a walk over
+// pre-split chunks rather than a re-parse.
+type varsProgram []varsOp
+
+// hasVarsSyntax reports whether s contains at least one $(...) reference,
+// the trigger for compiling it with compileVars instead of treating it as a
+// plain literal.
+func hasVarsSyntax(s string) bool {
+	return strings.Contains(s, "$(")
+}
+
+// compileVars scans s for $(NAME), $(NAME{sub}) and $(NAME{sub}|'default')
+// references and compiles it into a varsProgram. A non-empty string without
+// any reference compiles to a single literal op; an empty string compiles to
+// no ops.
+func compileVars(s string) (varsProgram, error) {
+	var prog varsProgram
+	for len(s) > 0 {
+		idx := strings.Index(s, "$(")
+		if idx < 0 {
+			prog = append(prog, varsOp{literal: s})
+			break
+		}
+		if idx > 0 {
+			prog = append(prog, varsOp{literal: s[:idx]})
+		}
+
+		p := &exprParser{s: s[idx:]}
+		node, err := p.parseVariable()
+		if err != nil {
+			return nil, errors.Wrapf(err, "[esitag] compileVars: %q", s)
+		}
+		vn, ok := node.(variableNode)
+		if !ok {
+			return nil, errors.Errorf("[esitag] compileVars: %q did not compile to a variable reference", s)
+		}
+		prog = append(prog, varsOp{ref: &vn})
+		s = s[idx+p.pos:]
+	}
+	return prog, nil
+}
+
+// Eval resolves every op in p against r and concatenates the result.
+func (p varsProgram) Eval(r *http.Request) (string, error) {
+	if len(p) == 1 && p[0].ref == nil {
+		return p[0].literal, nil
+	}
+	var buf bytes.Buffer
+	for _, op := range p {
+		if op.ref == nil {
+			buf.WriteString(op.literal)
+			continue
+		}
+		v, err := op.ref.Eval(r)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(v.asString())
+	}
+	return buf.String(), nil
+}
+
+// resourceVarsEntry records that the src (or key) of the resource at index
+// contains ESI $(...) references that must be expanded per request rather
+// than once at parse time.
+type resourceVarsEntry struct {
+	index int
+	attr  string // "src" or "key"
+	prog  varsProgram
+}
+
+// addResourceVars records a compiled $(...) program for one resource
+// attribute; parseResource calls this instead of writing the raw value
+// straight onto the Resource when the value contains ESI variable syntax.
+func (et *Entity) addResourceVars(attr string, idx int, prog varsProgram) {
+	et.resourceVars = append(et.resourceVars, resourceVarsEntry{index: idx, attr: attr, prog: prog})
+}
+
+// ResolvedResources returns et.Resources with any src/key that carry ESI
+// $(...) references expanded against r. When none of its resources use
+// variable syntax it returns et.Resources unchanged so the common case stays
+// allocation-free.
+func (et *Entity) ResolvedResources(r *http.Request) (Resources, error) {
+	if len(et.resourceVars) == 0 {
+		return et.Resources, nil
+	}
+
+	items := make([]*Resource, len(et.Resources.Items))
+	copy(items, et.Resources.Items)
+	resolved := et.Resources
+	resolved.Items = items
+
+	for _, entry := range et.resourceVars {
+		for i, res := range items {
+			if res.Index != entry.index {
+				continue
+			}
+			val, err := entry.prog.Eval(r)
+			if err != nil {
+				return Resources{}, errors.Wrapf(err, "[esitag] ResolvedResources: failed to expand %s at index %d", entry.attr, entry.index)
+			}
+			cp := *res
+			switch entry.attr {
+			case "src":
+				cp.URL = val
+			case "key":
+				if err := cp.applyKey(val); err != nil {
+					return Resources{}, errors.Wrapf(err, "[esitag] ResolvedResources: failed to apply key %q at index %d", val, entry.index)
+				}
+			}
+			items[i] = &cp
+		}
+	}
+	return resolved, nil
+}
+
+// Vars represents a parsed <esi:vars>...</esi:vars> tag. Its body is
+// expanded against the current request and emitted directly to the output
+// stream; unlike KindInclude there is no backend fetch involved.
+type Vars struct {
+	Body varsProgram
+}
+
+// NewVars compiles the textual body of an <esi:vars> tag into a Vars value.
+func NewVars(body string) (*Vars, error) {
+	prog, err := compileVars(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "[esitag] NewVars: %q", body)
+	}
+	return &Vars{Body: prog}, nil
+}
+
+// Eval expands v's body against r.
+func (v *Vars) Eval(r *http.Request) (string, error) {
+	return v.Body.Eval(r)
+}
@@ -0,0 +1,75 @@
+package esitag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompileVarsLiteralOnly(t *testing.T) {
+	prog, err := compileVars("no variables here")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	got, err := prog.Eval(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "no variables here" {
+		t.Errorf("Eval() = %q, want %q", got, "no variables here")
+	}
+}
+
+func TestCompileVarsSubstitution(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?lang=de", nil)
+	r.Host = "example.com"
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"host=$(HTTP_HOST)", "host=example.com"},
+		{"$(HTTP_HOST)/$(QUERY_STRING{lang})", "example.com/de"},
+		{"prefix-$(HTTP_COOKIE{uid}|'anon')-suffix", "prefix-anon-suffix"},
+		{"no-vars-at-all", "no-vars-at-all"},
+	}
+	for _, tc := range tests {
+		prog, err := compileVars(tc.src)
+		if err != nil {
+			t.Fatalf("compileVars(%q): %v", tc.src, err)
+		}
+		got, err := prog.Eval(r)
+		if err != nil {
+			t.Fatalf("Eval(%q): %v", tc.src, err)
+		}
+		if got != tc.want {
+			t.Errorf("compileVars(%q).Eval() = %q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestHasVarsSyntax(t *testing.T) {
+	if !hasVarsSyntax("x $(HTTP_HOST) y") {
+		t.Error("expected true for a string containing $(...)")
+	}
+	if hasVarsSyntax("no variables here") {
+		t.Error("expected false for a plain string")
+	}
+}
+
+func TestNewVarsEval(t *testing.T) {
+	v, err := NewVars("host=$(HTTP_HOST)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "example.com"
+	got, err := v.Eval(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "host=example.com" {
+		t.Errorf("Eval() = %q, want %q", got, "host=example.com")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vdobler/ht/ht"
+)
+
+func init() {
+	RegisterTest(page03(), page03(), page03())
+}
+
+var page03Counter int
+
+func page03() *ht.Test {
+	page03Counter++
+	return &ht.Test{
+		Name:        fmt.Sprintf("Page Escape Choose Iteration %d", page03Counter),
+		Description: `Request loads page_escape_choose.html, whose esi:choose/esi:when/esi:otherwise block is wrapped in a <!--esi ... --> comment`,
+		Request: ht.Request{
+			Method: "GET",
+			URL:    caddyAddress + "page_escape_choose.html",
+			Header: http.Header{
+				"Accept":          []string{"text/html"},
+				"Accept-Encoding": []string{"gzip, deflate, br"},
+				"Cookie":          []string{"group=Blue"},
+			},
+			Timeout: 1 * time.Second,
+		},
+		Checks: ht.CheckList{
+			ht.StatusCode{Expect: 200},
+			&ht.None{
+				Of: ht.CheckList{
+					&ht.Body{Contains: "<!--esi"},
+					&ht.Body{Contains: "<esi:"},
+				},
+			},
+			&ht.Body{
+				Contains: ` class="page03ChooseWhenBlue"`,
+				Count:    1,
+			},
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vdobler/ht/ht"
+)
+
+func init() {
+	RegisterTest(page02(), page02(), page02())
+}
+
+var page02Counter int
+
+func page02() *ht.Test {
+	page02Counter++
+	return &ht.Test{
+		Name:        fmt.Sprintf("Page Escape Include Iteration %d", page02Counter),
+		Description: `Request loads page_escape_include.html, whose single esi:include is wrapped in a <!--esi ... --> comment`,
+		Request: ht.Request{
+			Method: "GET",
+			URL:    caddyAddress + "page_escape_include.html",
+			Header: http.Header{
+				"Accept":          []string{"text/html"},
+				"Accept-Encoding": []string{"gzip, deflate, br"},
+			},
+			Timeout: 1 * time.Second,
+		},
+		Checks: ht.CheckList{
+			ht.StatusCode{Expect: 200},
+			&ht.None{
+				Of: ht.CheckList{
+					&ht.Body{Contains: "<!--esi"},
+					&ht.Body{Contains: "<esi:"},
+				},
+			},
+			&ht.Body{
+				Contains: ` class="page02IncludeLoaded"`,
+				Count:    1,
+			},
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vdobler/ht/ht"
+)
+
+func init() {
+	RegisterTest(page04(), page04(), page04())
+}
+
+var page04Counter int
+
+func page04() *ht.Test {
+	page04Counter++
+	return &ht.Test{
+		Name:        fmt.Sprintf("Page Remove Nested Iteration %d", page04Counter),
+		Description: `Request loads page_remove_nested.html, which nests one esi:remove block inside another; both must be stripped from the response`,
+		Request: ht.Request{
+			Method: "GET",
+			URL:    caddyAddress + "page_remove_nested.html",
+			Header: http.Header{
+				"Accept":          []string{"text/html"},
+				"Accept-Encoding": []string{"gzip, deflate, br"},
+			},
+			Timeout: 1 * time.Second,
+		},
+		Checks: ht.CheckList{
+			ht.StatusCode{Expect: 200},
+			&ht.None{
+				Of: ht.CheckList{
+					&ht.Body{Contains: "esi:remove"},
+					&ht.HTMLContains{
+						Selector: `html`,
+						Text:     []string{"page04FallbackOuter", "page04FallbackInner"},
+					},
+				},
+			},
+			&ht.Body{
+				Contains: ` class="page04Loaded"`,
+				Count:    1,
+			},
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package esi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fragmentCache is a mutex-guarded in-memory cache of fully rendered
+// response bodies, keyed by cacheKey. It backs Middleware's "inmemory" Cache
+// setting.
+type fragmentCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func newFragmentCache(ttl time.Duration) *fragmentCache {
+	return &fragmentCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// get returns the cached body for key, if present and not yet expired.
+func (c *fragmentCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// set stores data under key, replacing any previous entry, with a fresh
+// expiry c.ttl from now.
+func (c *fragmentCache) set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{data: data, expires: time.Now().Add(c.ttl)}
+}
+
+// cacheKey derives the whole-page cache key for r. It must incorporate every
+// request input the esitag condition/vars evaluators can read, not just the
+// URL: esi:choose conditions and esi:vars routinely branch on
+// $(HTTP_HOST), $(HTTP_COOKIE{...}), $(HTTP_USER_AGENT),
+// $(HTTP_ACCEPT_LANGUAGE) and $(HTTP_REFERER), so a key derived from the URL alone would let one
+// visitor's personalized render leak to every other visitor of that URL for
+// the cache's TTL. A condition that reads an arbitrary header via
+// $(HTTP_HEADER{name}) outside this fixed list is not covered; Cache must
+// not be combined with such a condition.
+func cacheKey(r *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	h.Write([]byte{0})
+	io.WriteString(h, r.URL.String())
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("Cookie"))
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("User-Agent"))
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("Accept-Language"))
+	h.Write([]byte{0})
+	io.WriteString(h, r.Header.Get("Referer"))
+	h.Write([]byte{0})
+	io.WriteString(h, r.Host)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// namedBackendInclude matches a whole self-closing esi:include tag whose src
+// attribute references a configured backend by name instead of an absolute
+// URL, e.g. <esi:include src="resource://product/42"/>.
+var namedBackendInclude = regexp.MustCompile(`<esi:include\s[^>]*?src=["']resource://([a-zA-Z][\w-]*)((?:/[^"'\r\n]*)?)["'][^>]*/>`)
+
+// resolveNamedBackends replaces every esi:include tag whose src is a
+// "resource://name/path" reference with the fragment fetched from the
+// backend registered under name, using m.backends' pooled http.Client so
+// repeated requests reuse connections. It runs before the generic esitag
+// pipeline, which has no notion of Middleware's named Resources, and
+// replaces the whole tag since there is no further processing left to do for
+// it once its content has been fetched. A failed fetch falls back to m's
+// module-level OnError, same as an esi:include without its own onerror
+// attribute: "remove" (the default) drops the tag, "continue" keeps its
+// original markup visible in the output, escaped so it cannot be picked up
+// as a tag again by the generic esitag pipeline that runs after this one.
+func (m *Middleware) resolveNamedBackends(body []byte) []byte {
+	if len(m.backends) == 0 {
+		return body
+	}
+	return namedBackendInclude.ReplaceAllFunc(body, func(match []byte) []byte {
+		sub := namedBackendInclude.FindSubmatch(match)
+		name, path := string(sub[1]), string(sub[2])
+
+		client, ok := m.backends[name]
+		if !ok {
+			m.logger.Warn("esi: esi:include references unknown backend", zap.String("backend", name))
+			return m.onErrorFallback(match)
+		}
+		dsn := m.Resources[name]
+
+		resp, err := client.Get(dsn + path)
+		if err != nil {
+			m.logger.Warn("esi: backend request failed", zap.String("backend", name), zap.Error(err))
+			return m.onErrorFallback(match)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			m.logger.Warn("esi: backend returned non-2xx status", zap.String("backend", name), zap.Int("status", resp.StatusCode))
+			return m.onErrorFallback(match)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			m.logger.Warn("esi: reading backend response failed", zap.String("backend", name), zap.Error(err))
+			return m.onErrorFallback(match)
+		}
+		return data
+	})
+}
+
+// onErrorFallback returns the replacement for a named-backend include tag
+// whose fetch failed, applying m.OnError: "continue" keeps origTag visible,
+// HTML-escaped so the downstream esitag pipeline does not try to resolve it
+// a second time as a plain URL include; "remove" drops it.
+func (m *Middleware) onErrorFallback(origTag []byte) []byte {
+	if m.OnError == "continue" {
+		return []byte(html.EscapeString(string(origTag)))
+	}
+	return nil
+}
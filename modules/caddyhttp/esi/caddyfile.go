@@ -0,0 +1,92 @@
+package esi
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	httpcaddyfile.RegisterHandlerDirective("esi", parseCaddyfile)
+}
+
+// parseCaddyfile sets up the esi handler from Caddyfile tokens. Syntax:
+//
+//	esi {
+//	    timeout         5s
+//	    ttl             1m
+//	    on_error        remove
+//	    allowed_methods GET HEAD
+//	    cache           inmemory
+//	    resource        product https://products.example.com
+//	}
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(Middleware)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing timeout: %v", err)
+				}
+				m.Timeout = caddy.Duration(dur)
+
+			case "ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing ttl: %v", err)
+				}
+				m.TTL = caddy.Duration(dur)
+
+			case "on_error":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnError = d.Val()
+
+			case "allowed_methods":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.AllowedMethods = args
+
+			case "cache":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Cache = d.Val()
+
+			case "resource":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.Errf("resource requires a name and a DSN, got %v", args)
+				}
+				if m.Resources == nil {
+					m.Resources = make(map[string]string)
+				}
+				m.Resources[args[0]] = args[1]
+
+			default:
+				return d.Errf("unrecognized esi directive: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+var _ caddyfile.Unmarshaler = (*Middleware)(nil)
@@ -0,0 +1,202 @@
+// Package esi implements Edge Side Includes as a Caddy v2 HTTP handler
+// module. It scans a response body for <esi:...> tags using the esitag
+// package and replaces them with content fetched from the configured
+// backend resources, the same pipeline esitag.Entities.QueryResources has
+// always driven for the v1 Caddyfile-only middleware.
+package esi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SchumacherFM/caddyesi/esitag"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Middleware{})
+}
+
+// Middleware runs the ESI tag scan/replace pipeline over every response
+// that passes through it.
+type Middleware struct {
+	// Timeout bounds how long a single backend resource may take to
+	// respond before its esi:include falls back to OnError handling.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// TTL is the lifetime of a cached rendered page when Cache is enabled.
+	// It is not applied to individual fragments, and a tag without its own
+	// ttl attribute does not inherit it.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+	// OnError is the failure behaviour ("remove" or "continue") applied to
+	// an esi:include whose src names a backend from Resources. It does not
+	// apply to other tags: when one of those fails, the whole body is
+	// served unmodified.
+	OnError string `json:"on_error,omitempty"`
+	// AllowedMethods restricts ESI processing to these HTTP methods; only
+	// GET requests are processed when it is empty.
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// Cache configures the cache of whole rendered pages. Only ""
+	// (disabled) and "inmemory" are currently supported.
+	Cache string `json:"cache,omitempty"`
+	// Resources maps a named backend, as referenced from an esi:include's
+	// src attribute via the "resource://name/..." scheme, to its DSN.
+	Resources map[string]string `json:"resources,omitempty"`
+
+	logger   *zap.Logger
+	cache    *fragmentCache
+	backends map[string]*http.Client
+}
+
+// CaddyModule returns the Caddy module information.
+func (Middleware) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.esi",
+		New: func() caddy.Module { return new(Middleware) },
+	}
+}
+
+// defaultCacheTTL applies when Cache is enabled but TTL was left unset.
+const defaultCacheTTL = 10 * time.Second
+
+// Provision sets up m's logger, fragment cache and backend clients. It runs
+// again whenever the admin API re-provisions this module's config, so it
+// must not assume it only ever runs once, and must not leak what a previous
+// run constructed.
+func (m *Middleware) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	if m.OnError == "" {
+		m.OnError = "remove"
+	}
+
+	if m.Cache == "inmemory" {
+		ttl := time.Duration(m.TTL)
+		if ttl <= 0 {
+			ttl = defaultCacheTTL
+		}
+		m.cache = newFragmentCache(ttl)
+	} else {
+		m.cache = nil
+	}
+
+	backends := make(map[string]*http.Client, len(m.Resources))
+	for name := range m.Resources {
+		backends[name] = &http.Client{Timeout: time.Duration(m.Timeout)}
+	}
+	m.backends = backends
+
+	return nil
+}
+
+// Validate checks m's config for consistency.
+func (m *Middleware) Validate() error {
+	if m.Timeout < 0 {
+		return fmt.Errorf("esi: timeout must not be negative")
+	}
+	if m.TTL < 0 {
+		return fmt.Errorf("esi: ttl must not be negative")
+	}
+	switch m.OnError {
+	case "remove", "continue":
+	default:
+		return fmt.Errorf("esi: on_error must be %q or %q, got %q", "remove", "continue", m.OnError)
+	}
+	switch m.Cache {
+	case "", "inmemory":
+	default:
+		return fmt.Errorf("esi: cache %q is not supported, only %q and %q are", m.Cache, "", "inmemory")
+	}
+	for name, dsn := range m.Resources {
+		if dsn == "" {
+			return fmt.Errorf("esi: resource %q has an empty DSN", name)
+		}
+	}
+	return nil
+}
+
+// Cleanup releases anything m acquired during Provision. It is called when
+// the admin API tears down a previous config generation, e.g. after a
+// reload removes or replaces this handler.
+func (m *Middleware) Cleanup() error {
+	for _, c := range m.backends {
+		c.CloseIdleConnections()
+	}
+	m.backends = nil
+	m.cache = nil
+	return nil
+}
+
+// ServeHTTP buffers the downstream response, runs the ESI scan/replace
+// pipeline over it and writes the result, unless the request's method is
+// not in AllowedMethods, in which case it passes the response through
+// untouched. A cache hit short-circuits the whole pipeline, including the
+// downstream request.
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if !m.methodAllowed(r.Method) {
+		return next.ServeHTTP(w, r)
+	}
+
+	key := cacheKey(r)
+	if m.cache != nil {
+		if data, ok := m.cache.get(key); ok {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(data)
+			return err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	rec := caddyhttp.NewResponseRecorder(w, buf, func(status int, header http.Header) bool {
+		return true
+	})
+	if err := next.ServeHTTP(rec, r); err != nil {
+		return err
+	}
+	if !rec.Buffered() {
+		return nil
+	}
+
+	body := esitag.Preprocess(buf.Bytes())
+	body = m.resolveNamedBackends(body)
+
+	out, err := esitag.Render(body, r)
+	if err != nil {
+		m.logger.Error("esi: rendering ESI tags failed, serving body unmodified", zap.Error(err))
+		return rec.WriteResponse()
+	}
+
+	if m.cache != nil {
+		m.cache.set(key, out)
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
+	rec.Header().Del("Content-Length")
+	w.WriteHeader(rec.Status())
+	_, err = w.Write(out)
+	return err
+}
+
+func (m *Middleware) methodAllowed(method string) bool {
+	if len(m.AllowedMethods) == 0 {
+		return method == http.MethodGet
+	}
+	for _, am := range m.AllowedMethods {
+		if strings.EqualFold(am, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface guards.
+var (
+	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
+)